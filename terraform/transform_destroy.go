@@ -1,6 +1,10 @@
 package terraform
 
 import (
+	"fmt"
+	"path"
+	"strings"
+
 	"github.com/hashicorp/terraform/dag"
 )
 
@@ -44,14 +48,52 @@ type GraphNodeDestroyEdgeInclude interface {
 	DestroyEdgeInclude(dag.Vertex) bool
 }
 
+// GraphNodeReplacePhased is implemented by nodes that want to inject extra
+// vertices into the replace subgraph that DestroyTransformer builds for a
+// CreateBeforeDestroy resource. Both methods may return nil if the node
+// doesn't need that phase.
+type GraphNodeReplacePhased interface {
+	// PostCreateNode returns a vertex that runs after the replacement
+	// resource has been created but before the old resource is
+	// destroyed. Providers use this to clean up the old resource while
+	// it is still live, e.g. draining connections or deregistering it
+	// from a load balancer, before it is torn down.
+	PostCreateNode() dag.Vertex
+
+	// PreDestroyNode returns a vertex that runs immediately before the
+	// destroy node, after PostCreateNode (if any) has completed.
+	PreDestroyNode() dag.Vertex
+}
+
 // DestroyTransformer is a GraphTransformer that creates the destruction
 // nodes for things that _might_ be destroyed.
 type DestroyTransformer struct {
 	FullDestroy bool
+
+	// Diagnostics is populated by Transform with any non-fatal issues it
+	// surfaced, such as edges it removed to break a cycle inherited
+	// from the create graph. Callers that only have access to the
+	// GraphTransformer interface can read this after Transform returns.
+	Diagnostics []Diagnostic
 }
 
 func (t *DestroyTransformer) Transform(g *Graph) error {
-	var connect, remove []dag.Edge
+	diags, err := t.TransformWithDiagnostics(g)
+	t.Diagnostics = diags
+	return err
+}
+
+// TransformWithDiagnostics does the work of Transform, but returns the
+// diagnostics instead of storing them in t.Diagnostics. Both run a
+// cycle-detection pass once all destroy edges are wired up. Any cycle
+// that was introduced by an edge this transform inherited from the create
+// graph is broken automatically by removing the most recently inherited
+// edge involved, and the removal is reported back as a Diagnostic rather
+// than silently dropped. This avoids needing a new
+// GraphNodeDestroyEdgeInclude implementation every time a provider
+// introduces a self-referential dependency.
+func (t *DestroyTransformer) TransformWithDiagnostics(g *Graph) ([]Diagnostic, error) {
+	var connect, remove, inherited []dag.Edge
 	nodeToCn := make(map[dag.Vertex]dag.Vertex, len(g.Vertices()))
 	nodeToDn := make(map[dag.Vertex]dag.Vertex, len(g.Vertices()))
 	for _, v := range g.Vertices() {
@@ -90,12 +132,15 @@ func (t *DestroyTransformer) Transform(g *Graph) error {
 				continue
 			}
 
-			g.Connect(dag.BasicEdge(n, edgeRaw.(dag.Vertex)))
+			e := dag.BasicEdge(n, edgeRaw.(dag.Vertex))
+			g.Connect(e)
+			inherited = append(inherited, e)
 		}
 
 		// Add a new edge to connect the node to be created to
-		// the destroy node.
-		connect = append(connect, dag.BasicEdge(v, n))
+		// the destroy node, routing through any replace-phase hook
+		// vertices the node wants to run in between.
+		connect = append(connect, t.replaceEdges(g, v, n)...)
 	}
 
 	// Go through the nodes we added and determine if they depend
@@ -129,7 +174,143 @@ func (t *DestroyTransformer) Transform(g *Graph) error {
 		g.RemoveEdge(e)
 	}
 
-	return nil
+	// Inherited edges that the transpose step above replaced are no longer
+	// in the graph, so they can't be on a cycle.
+	live := inherited[:0]
+	for _, e := range inherited {
+		gone := false
+		for _, r := range remove {
+			if e.Source() == r.Source() && e.Target() == r.Target() {
+				gone = true
+				break
+			}
+		}
+		if !gone {
+			live = append(live, e)
+		}
+	}
+
+	return t.breakInheritedCycles(g, live), nil
+}
+
+// Diagnostic describes a non-fatal issue that a transform surfaced about the
+// graph it produced, rather than failing outright.
+type Diagnostic struct {
+	Summary string
+}
+
+func (d Diagnostic) String() string {
+	return d.Summary
+}
+
+// breakInheritedCycles looks for cycles in the graph and, for any cycle it
+// finds, removes the most recently inherited destroy edge that actually
+// participates in that cycle, re-checking until no cycles remain or none of
+// the remaining inherited edges are on one. It uses Cycles() rather than
+// Validate() because Validate also fails for unrelated reasons (e.g.
+// multiple roots), which isn't something an inherited edge can fix. Cycles()
+// doesn't report a vertex that depends on itself, so an inherited self-loop
+// is treated as a cycle of its own. Each
+// edge it removes is reported back as a Diagnostic so the cycle-break isn't
+// silent, and edges that aren't on a cycle are left alone so legitimate
+// destroy ordering survives.
+func (t *DestroyTransformer) breakInheritedCycles(g *Graph, inherited []dag.Edge) []Diagnostic {
+	var diags []Diagnostic
+
+	for {
+		cycles := g.Cycles()
+
+		removed := false
+		for i := len(inherited) - 1; i >= 0; i-- {
+			e := inherited[i]
+			if !edgeOnCycle(e, cycles) {
+				continue
+			}
+
+			g.RemoveEdge(e)
+			inherited = append(inherited[:i], inherited[i+1:]...)
+			diags = append(diags, Diagnostic{
+				Summary: fmt.Sprintf(
+					"removed inherited destroy edge %q -> %q to break a cycle",
+					dag.VertexName(e.Source()), dag.VertexName(e.Target())),
+			})
+			removed = true
+			break
+		}
+
+		if !removed {
+			// None of the remaining inherited edges are on a cycle;
+			// nothing more we can safely break.
+			break
+		}
+	}
+
+	return diags
+}
+
+// edgeOnCycle reports whether e is a self-loop or connects two vertices that
+// belong to the same cycle.
+func edgeOnCycle(e dag.Edge, cycles [][]dag.Vertex) bool {
+	if e.Source() == e.Target() {
+		return true
+	}
+
+	for _, cycle := range cycles {
+		var hasSource, hasTarget bool
+		for _, v := range cycle {
+			if v == e.Source() {
+				hasSource = true
+			}
+			if v == e.Target() {
+				hasTarget = true
+			}
+		}
+		if hasSource && hasTarget {
+			return true
+		}
+	}
+
+	return false
+}
+
+// replaceEdges returns the edges needed to chain the create node v to its
+// destroy node n. The direct v -> n edge is always included and is left
+// untouched, since CreateBeforeDestroyTransformer looks for exactly that
+// edge to reverse when putting create before destroy. For a
+// CreateBeforeDestroy node that implements GraphNodeReplacePhased, the
+// optional PostCreateNode and PreDestroyNode vertices are added to the graph
+// and hung off that edge with their own dependency edges, so the realized
+// order is create -> post-create -> pre-destroy -> destroy regardless of
+// how CreateBeforeDestroyTransformer handles the direct edge.
+func (t *DestroyTransformer) replaceEdges(g *Graph, v, n dag.Vertex) []dag.Edge {
+	edges := []dag.Edge{dag.BasicEdge(v, n)}
+
+	dn, ok := n.(GraphNodeDestroy)
+	if !ok || !dn.CreateBeforeDestroy() {
+		return edges
+	}
+
+	rp, ok := n.(GraphNodeReplacePhased)
+	if !ok {
+		return edges
+	}
+
+	last := v
+	for _, hook := range []dag.Vertex{rp.PostCreateNode(), rp.PreDestroyNode()} {
+		if hook == nil {
+			continue
+		}
+
+		g.Add(hook)
+		edges = append(edges, dag.BasicEdge(hook, last))
+		last = hook
+	}
+
+	if last != v {
+		edges = append(edges, dag.BasicEdge(n, last))
+	}
+
+	return edges
 }
 
 // noCreateBeforeDestroyAncestors verifies that a vertex has no ancestors that
@@ -193,3 +374,105 @@ func (t *PruneDestroyTransformer) Transform(g *Graph) error {
 
 	return nil
 }
+
+// TargetedDestroyTransformer is a GraphTransformer that prunes destroy nodes
+// that don't match a set of target address globs (e.g. "aws_instance.foo" or
+// "module.child.aws_instance.foo"), so that `terraform destroy -target=...`
+// only tears down the requested resources.
+//
+// Unlike PruneDestroyTransformer, which only consults the diff/state,
+// TargetedDestroyTransformer walks the graph: a destroy node that a target
+// depends on is kept even if it doesn't match, since destroying a target
+// without also destroying what it depends on would leave the target
+// referencing resources that no longer exist in state.
+type TargetedDestroyTransformer struct {
+	// Targets are glob patterns matched against each destroy node's
+	// module-qualified address. A target that names a module (with no
+	// trailing resource) matches every resource within that module.
+	Targets []string
+
+	// FullDestroy, when true, disables targeting: every destroy node is
+	// kept regardless of Targets.
+	FullDestroy bool
+}
+
+func (t *TargetedDestroyTransformer) Transform(g *Graph) error {
+	if t.FullDestroy || len(t.Targets) == 0 {
+		return nil
+	}
+
+	keep := make(map[dag.Vertex]struct{})
+	for _, v := range g.Vertices() {
+		if _, ok := v.(GraphNodeDestroy); !ok {
+			continue
+		}
+
+		if !t.matches(v) {
+			continue
+		}
+
+		keep[v] = struct{}{}
+
+		// Keep the destroy nodes of everything this target depends on,
+		// so that they are destroyed along with it. Ancestors,
+		// not Descendents, is what holds a vertex's dependencies: see
+		// noCreateBeforeDestroyAncestors, which relies on the same
+		// convention.
+		deps, _ := g.Ancestors(v)
+		if deps == nil {
+			continue
+		}
+		for _, d := range deps.List() {
+			keep[d] = struct{}{}
+		}
+	}
+
+	for _, v := range g.Vertices() {
+		if _, ok := v.(GraphNodeDestroy); !ok {
+			continue
+		}
+
+		if _, ok := keep[v]; !ok {
+			g.Remove(v)
+		}
+	}
+
+	return nil
+}
+
+// matches reports whether v's module-qualified address matches any of the
+// configured target globs.
+func (t *TargetedDestroyTransformer) matches(v dag.Vertex) bool {
+	addr := resourceAddr(dag.VertexName(v))
+	if pn, ok := v.(GraphNodeSubPath); ok {
+		// Path() includes the "root" sentinel for the root module, so
+		// a root resource's own address needs no "module." prefix.
+		if modPath := pn.Path(); len(modPath) > 1 {
+			addr = "module." + strings.Join(modPath[1:], ".module.") + "." + addr
+		}
+	}
+
+	for _, target := range t.Targets {
+		if ok, _ := path.Match(target, addr); ok {
+			return true
+		}
+
+		// A target naming a module should also match everything
+		// contained within that module.
+		if strings.HasPrefix(addr, target+".") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// resourceAddr strips the parenthesized phase suffix that destroy-graph
+// vertex names carry (e.g. "aws_instance.foo (destroy)"), so the
+// bare resource address can be compared against a target glob.
+func resourceAddr(name string) string {
+	if i := strings.Index(name, " ("); i >= 0 {
+		return name[:i]
+	}
+	return name
+}
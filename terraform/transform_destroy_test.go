@@ -0,0 +1,229 @@
+package terraform
+
+import (
+	"testing"
+
+	"github.com/hashicorp/terraform/dag"
+)
+
+// testDestroyNode is a GraphNodeDestroy (and optionally GraphNodeSubPath /
+// GraphNodeReplacePhased) used to exercise DestroyTransformer and
+// TargetedDestroyTransformer without pulling in real resource nodes.
+type testDestroyNode struct {
+	NameValue string
+	CBD       bool
+	Create    dag.Vertex
+	Post      dag.Vertex
+	Pre       dag.Vertex
+	ModPath   []string
+}
+
+func (n *testDestroyNode) Name() string             { return n.NameValue }
+func (n *testDestroyNode) CreateBeforeDestroy() bool { return n.CBD }
+func (n *testDestroyNode) CreateNode() dag.Vertex    { return n.Create }
+func (n *testDestroyNode) PostCreateNode() dag.Vertex { return n.Post }
+func (n *testDestroyNode) PreDestroyNode() dag.Vertex { return n.Pre }
+func (n *testDestroyNode) Path() []string            { return n.ModPath }
+
+// testCreateNode is a GraphNodeDestroyable whose destroy side is a
+// testDestroyNode.
+type testCreateNode struct {
+	NameValue string
+	Destroy   *testDestroyNode
+}
+
+func (n *testCreateNode) Name() string                  { return n.NameValue }
+func (n *testCreateNode) DestroyNode() GraphNodeDestroy { return n.Destroy }
+
+// testHookNode is a bare vertex, used both as a replace-phase hook and as a
+// generic vertex in the cycle-breaking tests.
+type testHookNode struct {
+	NameValue string
+}
+
+func (n *testHookNode) Name() string { return n.NameValue }
+
+func assertEdge(t *testing.T, g *Graph, source, target dag.Vertex) {
+	t.Helper()
+
+	for _, raw := range g.DownEdges(source).List() {
+		if raw.(dag.Vertex) == target {
+			return
+		}
+	}
+
+	t.Fatalf("expected edge %q -> %q", dag.VertexName(source), dag.VertexName(target))
+}
+
+func assertNoEdge(t *testing.T, g *Graph, source, target dag.Vertex) {
+	t.Helper()
+
+	for _, raw := range g.DownEdges(source).List() {
+		if raw.(dag.Vertex) == target {
+			t.Fatalf("unexpected edge %q -> %q", dag.VertexName(source), dag.VertexName(target))
+		}
+	}
+}
+
+func TestDestroyTransformer_replacePhased(t *testing.T) {
+	post := &testHookNode{NameValue: "aws_instance.foo (post-create)"}
+	pre := &testHookNode{NameValue: "aws_instance.foo (pre-destroy)"}
+	dn := &testDestroyNode{NameValue: "aws_instance.foo (destroy)", CBD: true, Post: post, Pre: pre}
+	cn := &testCreateNode{NameValue: "aws_instance.foo", Destroy: dn}
+	dn.Create = cn
+
+	var g Graph
+	g.Add(cn)
+
+	tf := &DestroyTransformer{}
+	if err := tf.Transform(&g); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The direct create -> destroy edge must survive untouched, since
+	// CreateBeforeDestroyTransformer looks for it to reverse.
+	assertEdge(t, &g, cn, dn)
+
+	// The hooks must independently enforce create -> post-create ->
+	// pre-destroy -> destroy.
+	assertEdge(t, &g, post, cn)
+	assertEdge(t, &g, pre, post)
+	assertEdge(t, &g, dn, pre)
+}
+
+func TestDestroyTransformer_replaceNotPhased(t *testing.T) {
+	// A plain (non-CBD) destroy shouldn't gain any hooks even if it
+	// implements GraphNodeReplacePhased.
+	post := &testHookNode{NameValue: "aws_instance.foo (post-create)"}
+	dn := &testDestroyNode{NameValue: "aws_instance.foo (destroy)", CBD: false, Post: post}
+	cn := &testCreateNode{NameValue: "aws_instance.foo", Destroy: dn}
+	dn.Create = cn
+
+	var g Graph
+	g.Add(cn)
+
+	tf := &DestroyTransformer{}
+	if err := tf.Transform(&g); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	assertEdge(t, &g, cn, dn)
+	assertNoEdge(t, &g, post, cn)
+}
+
+func TestTargetedDestroyTransformer_root(t *testing.T) {
+	// Root-module destroy nodes render as just their resource address
+	// with a "(destroy)" suffix, and Path() returns ["root"] for them -
+	// targeting the bare address must still match.
+	foo := &testDestroyNode{NameValue: "aws_instance.foo (destroy)", ModPath: []string{"root"}}
+	dep := &testDestroyNode{NameValue: "aws_instance.dep (destroy)", ModPath: []string{"root"}}
+	other := &testDestroyNode{NameValue: "aws_instance.other (destroy)", ModPath: []string{"root"}}
+
+	var g Graph
+	g.Add(foo)
+	g.Add(dep)
+	g.Add(other)
+	g.Connect(dag.BasicEdge(foo, dep))
+
+	tf := &TargetedDestroyTransformer{Targets: []string{"aws_instance.foo"}}
+	if err := tf.Transform(&g); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	remaining := map[dag.Vertex]bool{}
+	for _, v := range g.Vertices() {
+		remaining[v] = true
+	}
+
+	if !remaining[foo] {
+		t.Fatalf("expected targeted node to remain")
+	}
+	if !remaining[dep] {
+		t.Fatalf("expected target's dependency to remain")
+	}
+	if remaining[other] {
+		t.Fatalf("expected non-targeted node to be removed")
+	}
+}
+
+func TestTargetedDestroyTransformer_nestedModule(t *testing.T) {
+	root := &testDestroyNode{NameValue: "aws_instance.foo (destroy)", ModPath: []string{"root"}}
+	child := &testDestroyNode{NameValue: "aws_instance.bar (destroy)", ModPath: []string{"root", "child"}}
+
+	var g Graph
+	g.Add(root)
+	g.Add(child)
+
+	tf := &TargetedDestroyTransformer{Targets: []string{"module.child.aws_instance.bar"}}
+	if err := tf.Transform(&g); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	vs := g.Vertices()
+	if len(vs) != 1 || vs[0] != dag.Vertex(child) {
+		t.Fatalf("expected only the targeted child module node to remain, got %#v", vs)
+	}
+}
+
+func TestDestroyTransformer_breakInheritedCycles(t *testing.T) {
+	a := &testHookNode{NameValue: "a"}
+	b := &testHookNode{NameValue: "b"}
+	c := &testHookNode{NameValue: "c"}
+
+	var g Graph
+	g.Add(a)
+	g.Add(b)
+	g.Add(c)
+
+	// a -> b is a legitimate, cycle-free destroy-ordering edge and must
+	// survive the break.
+	ab := dag.BasicEdge(a, b)
+	g.Connect(ab)
+
+	// b -> c -> b is the cycle an inherited edge introduced.
+	bc := dag.BasicEdge(b, c)
+	cb := dag.BasicEdge(c, b)
+	g.Connect(bc)
+	g.Connect(cb)
+
+	tf := &DestroyTransformer{}
+	diags := tf.breakInheritedCycles(&g, []dag.Edge{ab, bc, cb})
+
+	if len(diags) != 1 {
+		t.Fatalf("expected exactly one diagnostic, got %d: %#v", len(diags), diags)
+	}
+
+	// The legitimate edge must not have been touched.
+	assertEdge(t, &g, a, b)
+
+	if len(g.Cycles()) != 0 {
+		t.Fatalf("graph should be acyclic after breaking the cycle")
+	}
+}
+
+func TestDestroyTransformer_TransformSurfacesDiagnostics(t *testing.T) {
+	dn := &testDestroyNode{NameValue: "aws_instance.foo (destroy)"}
+	cn := &testCreateNode{NameValue: "aws_instance.foo", Destroy: dn}
+	dn.Create = cn
+
+	var g Graph
+	g.Add(cn)
+	g.Add(dn)
+	// Pre-seed an edge from the create node to its own destroy node, so
+	// that Transform's edge-inheritance step copies it onto dn as a
+	// self-loop (dn depends on itself), giving us a real cycle to break.
+	g.Connect(dag.BasicEdge(cn, dn))
+
+	tf := &DestroyTransformer{}
+	if err := tf.Transform(&g); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if len(tf.Diagnostics) != 1 {
+		t.Fatalf("expected Transform to surface one diagnostic, got %d: %#v", len(tf.Diagnostics), tf.Diagnostics)
+	}
+
+	if len(g.Cycles()) != 0 {
+		t.Fatalf("graph should be acyclic after Transform")
+	}
+}